@@ -0,0 +1,89 @@
+// +build go1.12
+
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xds
+
+import (
+	"github.com/gogo/protobuf/proto"
+	rpcstatus "github.com/gogo/googleapis/google/rpc"
+)
+
+// ackState tracks the version_info/response_nonce pair the client has most
+// recently accepted for a single type URL, plus the resource_names it is
+// subscribed to for that type. CDS and EDS each get their own ackState so
+// one type can be NACKed without perturbing the other's accepted version.
+type ackState struct {
+	resourceNames []string
+	versionInfo   string // version_info of the last *accepted* response
+	nonce         string // response_nonce of the last response seen, accepted or not
+}
+
+// ackTracker keeps one ackState per type URL for a client's ADS streams;
+// it outlives a single stream attempt, so accepted versions carry over to
+// the next one. It is not safe for concurrent use; adsCallAttempt only ever
+// touches it from the goroutine reading responses.
+type ackTracker struct {
+	states map[string]*ackState
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{states: make(map[string]*ackState)}
+}
+
+func (t *ackTracker) state(typeURL string) *ackState {
+	s, ok := t.states[typeURL]
+	if !ok {
+		s = &ackState{}
+		t.states[typeURL] = s
+	}
+	return s
+}
+
+// request builds the initial DiscoveryRequest for typeURL on a stream,
+// recording resourceNames so subsequent ACK/NACK requests keep requesting
+// the same resources. The response_nonce is always reset to "" here since
+// a nonce is scoped to a single stream, but version_info carries over from
+// any earlier stream attempt on the same ackTracker (s.versionInfo is left
+// untouched): per the xDS spec, resuming a subscription after a reconnect
+// must resend the last *accepted* version, not start over as if new.
+func (t *ackTracker) request(rv resourceVersion, typeURL string, resourceNames []string, node proto.Message) proto.Message {
+	s := t.state(typeURL)
+	s.resourceNames = resourceNames
+	s.nonce = ""
+	return rv.newRequest(typeURL, resourceNames, node, s.versionInfo, s.nonce, nil)
+}
+
+// ack records versionInfo/nonce as accepted for typeURL and returns the
+// DiscoveryRequest that ACKs them.
+func (t *ackTracker) ack(rv resourceVersion, typeURL, versionInfo, nonce string) proto.Message {
+	s := t.state(typeURL)
+	s.versionInfo = versionInfo
+	s.nonce = nonce
+	return rv.newRequest(typeURL, s.resourceNames, nil, s.versionInfo, s.nonce, nil)
+}
+
+// nack records nonce as the latest seen (without updating versionInfo, so
+// the previously accepted version is what gets re-requested) and returns
+// the DiscoveryRequest that NACKs it with errDetail explaining why.
+func (t *ackTracker) nack(rv resourceVersion, typeURL, nonce string, errDetail *rpcstatus.Status) proto.Message {
+	s := t.state(typeURL)
+	s.nonce = nonce
+	return rv.newRequest(typeURL, s.resourceNames, nil, s.versionInfo, s.nonce, errDetail)
+}
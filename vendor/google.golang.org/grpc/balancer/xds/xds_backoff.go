@@ -0,0 +1,88 @@
+// +build go1.12
+
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xds
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ConnectParams configures the retry backoff used between failed ADS
+// stream attempts, matching the grpc.io connection-backoff spec:
+// current = min(BaseDelay * Multiplier^retries, MaxDelay), then the actual
+// sleep is current randomized by +/-Jitter. It is passed to newXDSClient,
+// which uses DefaultConnectParams when given nil; the zero value is not
+// valid.
+type ConnectParams struct {
+	// MinConnectTimeout is the minimum duration an ADS stream must stay
+	// healthy (i.e. keep receiving responses without erroring) before
+	// makeADSCall resets its retry count back to zero. A control plane
+	// that accepts a stream and immediately closes it again cannot pin
+	// the client to a zero backoff this way.
+	MinConnectTimeout time.Duration
+	// BaseDelay is the delay used for the first retry.
+	BaseDelay time.Duration
+	// Multiplier is the factor by which the delay grows with each retry,
+	// applied before jitter.
+	Multiplier float64
+	// Jitter is the fractional amount of randomization applied to the
+	// computed delay, in [0, 1). A Jitter of 0.2 means the actual delay
+	// is the computed delay +/-20%.
+	Jitter float64
+	// MaxDelay is the upper bound on the computed delay, before jitter.
+	MaxDelay time.Duration
+}
+
+// DefaultConnectParams is used whenever newXDSClient is not given an
+// explicit ConnectParams.
+var DefaultConnectParams = ConnectParams{
+	MinConnectTimeout: 10 * time.Second,
+	BaseDelay:         1 * time.Second,
+	Multiplier:        1.6,
+	Jitter:            0.2,
+	MaxDelay:          120 * time.Second,
+}
+
+// connectParamsBackoff implements backoff.Strategy on top of a
+// ConnectParams, so it can be plugged into client.backoff exactly like the
+// backoff.Exponential it replaces.
+type connectParamsBackoff struct {
+	ConnectParams
+}
+
+func (cpb connectParamsBackoff) Backoff(retries int) time.Duration {
+	backoff, max := float64(cpb.BaseDelay), float64(cpb.MaxDelay)
+	for backoff < max && retries > 0 {
+		backoff *= cpb.Multiplier
+		retries--
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Randomize backoff by +/- Jitter, including on the first retry: the
+	// spec applies jitter to every computed delay, not just the steady
+	// state after the first backoff step.
+	backoff *= 1 + cpb.Jitter*(rand.Float64()*2-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
@@ -25,139 +25,162 @@ import (
 	"sync"
 	"time"
 
-	xdspb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	xdscorepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	xdsdiscoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	rpcstatus "github.com/gogo/googleapis/google/rpc"
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/internal/backoff"
-	"google.golang.org/grpc/internal/channelz"
 )
 
+// adsStreamDesc describes the (version-agnostic) bidi-streaming ADS RPC;
+// only the method name differs between xDS transport versions, so a single
+// grpc.StreamDesc is reused for both and the method is supplied per call.
+var adsStreamDesc = &grpc.StreamDesc{
+	StreamName:    "StreamAggregatedResources",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
 const (
 	grpcHostname     = "com.googleapis.trafficdirector.grpc_hostname"
-	cdsType          = "type.googleapis.com/envoy.api.v2.Cluster"
-	edsType          = "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
 	endpointRequired = "endpoints_required"
 )
 
-var (
-	defaultBackoffConfig = backoff.Exponential{
-		MaxDelay: 120 * time.Second,
-	}
-)
+var defaultBackoffConfig = connectParamsBackoff{ConnectParams: DefaultConnectParams}
 
 // client is responsible for connecting to the specified traffic director, passing the received
 // ADS response from the traffic director, and sending notification when communication with the
 // traffic director is lost.
 type client struct {
-	ctx          context.Context
-	cancel       context.CancelFunc
-	cli          xdsdiscoverypb.AggregatedDiscoveryServiceClient
-	opts         balancer.BuildOptions
-	balancerName string // the traffic director name
-	serviceName  string // the user dial target name
-	enableCDS    bool
-	newADS       func(ctx context.Context, resp proto.Message) error
-	loseContact  func(ctx context.Context)
-	cleanup      func()
-	backoff      backoff.Strategy
-
-	mu sync.Mutex
-	cc *grpc.ClientConn
+	ctx              context.Context
+	cancel           context.CancelFunc
+	opts             balancer.BuildOptions
+	balancerName     string // the traffic director name
+	serviceName      string // the user dial target name
+	enableCDS        bool
+	transportVersion TransportVersion // which xDS transport protocol version to speak
+	// newLDS, newRDS, newCDS and newEDS deliver one resource type each,
+	// rather than a single newADS, so an xdsResolver can watch the
+	// Listener/RouteConfiguration pair for service-config updates without
+	// also having to filter out Cluster/ClusterLoadAssignment traffic
+	// meant for the balancer. Any of the four may be nil, in which case
+	// responses of that type are ACKed without being delivered. Only LDS
+	// (and the RDS that follows it) depends on a callback being set: LDS
+	// is requested only when newLDS is non-nil, while CDS (per enableCDS)
+	// and EDS are requested whether or not newCDS/newEDS are set.
+	newLDS            func(ctx context.Context, resp proto.Message) error
+	newRDS            func(ctx context.Context, resp proto.Message) error
+	newCDS            func(ctx context.Context, resp proto.Message) error
+	newEDS            func(ctx context.Context, resp proto.Message) error
+	loseContact       func(ctx context.Context)
+	cleanup           func()
+	backoff           backoff.Strategy
+	minConnectTimeout time.Duration // how long a stream must stay healthy before retryCount resets
+
+	lrsStore         *Store           // non-nil enables a sibling LRS stream on the same transport
+	transportBuilder TransportBuilder // nil means use the package-level newTransportBuilder
+
+	// ackTracker survives across adsCallAttempt calls, not just within one,
+	// so a reconnect resumes from the last *accepted* version_info per xDS
+	// rather than re-subscribing as if brand new; adsCallAttempt is
+	// responsible for clearing the per-stream nonce on each new attempt.
+	ackTracker *ackTracker
+
+	mu        sync.Mutex
+	transport Transport
+	lrs       *lrsClient
 }
 
 func (c *client) run() {
-	c.dial()
+	c.connect()
+	if c.lrsStore != nil {
+		c.mu.Lock()
+		c.lrs = newLRSClient(c.transport, c.serviceName, c.serviceName, c.transportVersion, c.lrsStore, c.minConnectTimeout)
+		c.mu.Unlock()
+		go c.lrs.run()
+	}
 	c.makeADSCall()
 }
 
 func (c *client) close() {
 	c.cancel()
 	c.mu.Lock()
-	if c.cc != nil {
-		c.cc.Close()
+	if c.lrs != nil {
+		c.lrs.close()
+	}
+	if c.transport != nil {
+		c.transport.Close()
 	}
 	c.mu.Unlock()
 	c.cleanup()
 }
 
-func (c *client) dial() {
-	var dopts []grpc.DialOption
-	if creds := c.opts.DialCreds; creds != nil {
-		if err := creds.OverrideServerName(c.balancerName); err == nil {
-			dopts = append(dopts, grpc.WithTransportCredentials(creds))
-		} else {
-			grpclog.Warningf("xds: failed to override the server name in the credentials: %v, using Insecure", err)
-			dopts = append(dopts, grpc.WithInsecure())
-		}
-	} else {
-		dopts = append(dopts, grpc.WithInsecure())
-	}
-	if c.opts.Dialer != nil {
-		dopts = append(dopts, grpc.WithContextDialer(c.opts.Dialer))
+// connect builds the Transport used for the lifetime of this client,
+// either from c.transportBuilder (set by tests or embedders) or the
+// package-level default, which dials balancerName over gRPC.
+func (c *client) connect() {
+	builder := c.transportBuilder
+	if builder == nil {
+		builder = newTransportBuilder
 	}
-	// Explicitly set pickfirst as the balancer.
-	dopts = append(dopts, grpc.WithBalancerName(grpc.PickFirstBalancerName))
-	if channelz.IsOn() {
-		dopts = append(dopts, grpc.WithChannelzParentID(c.opts.ChannelzParentID))
-	}
-
-	cc, err := grpc.DialContext(c.ctx, c.balancerName, dopts...)
-	// Since this is a non-blocking dial, so if it fails, it due to some serious error (not network
-	// related) error.
+	transport, err := builder(c.ctx, c.balancerName, c.opts)
 	if err != nil {
-		grpclog.Fatalf("xds: failed to dial: %v", err)
+		grpclog.Fatalf("xds: failed to create transport: %v", err)
 	}
 	c.mu.Lock()
 	select {
 	case <-c.ctx.Done():
-		cc.Close()
+		transport.Close()
 	default:
-		// only assign c.cc when xds client has not been closed, to prevent ClientConn leak.
-		c.cc = cc
+		// only assign c.transport when xds client has not been closed, to
+		// prevent a transport leak.
+		c.transport = transport
 	}
 	c.mu.Unlock()
 }
 
-func (c *client) newCDSRequest() *xdspb.DiscoveryRequest {
-	cdsReq := &xdspb.DiscoveryRequest{
-		Node: &xdscorepb.Node{
-			Metadata: &types.Struct{
-				Fields: map[string]*types.Value{
-					grpcHostname: {
-						Kind: &types.Value_StringValue{StringValue: c.serviceName},
-					},
-				},
-			},
-		},
-		TypeUrl: cdsType,
-	}
-	return cdsReq
+func (c *client) newLDSRequest(t *ackTracker) proto.Message {
+	rv := c.resources()
+	return t.request(rv, rv.ldsType, []string{c.serviceName}, rv.buildNode(c.serviceName))
+}
+
+// newRDSRequest requests routeConfigName, the RDS resource name extracted
+// from a previously-received Listener by routeConfigName().
+func (c *client) newRDSRequest(t *ackTracker, routeConfigName string) proto.Message {
+	rv := c.resources()
+	return t.request(rv, rv.rdsType, []string{routeConfigName}, rv.buildNode(c.serviceName))
+}
+
+func (c *client) newCDSRequest(t *ackTracker) proto.Message {
+	rv := c.resources()
+	return t.request(rv, rv.cdsType, nil, rv.buildNode(c.serviceName))
+}
+
+// newCDSRequestForCluster re-subscribes CDS to clusterName, the cluster
+// name extracted from a previously-received RouteConfiguration by
+// clusterForService(). It narrows the initial wildcard CDS subscription
+// made by newCDSRequest once the resolver knows exactly which cluster the
+// matched route points to.
+func (c *client) newCDSRequestForCluster(t *ackTracker, clusterName string) proto.Message {
+	rv := c.resources()
+	return t.request(rv, rv.cdsType, []string{clusterName}, rv.buildNode(c.serviceName))
 }
 
-func (c *client) newEDSRequest() *xdspb.DiscoveryRequest {
-	edsReq := &xdspb.DiscoveryRequest{
-		Node: &xdscorepb.Node{
-			Metadata: &types.Struct{
-				Fields: map[string]*types.Value{
-					endpointRequired: {
-						Kind: &types.Value_BoolValue{BoolValue: c.enableCDS},
-					},
-				},
-			},
-		},
-		ResourceNames: []string{c.serviceName},
-		TypeUrl:       edsType,
+func (c *client) newEDSRequest(t *ackTracker) proto.Message {
+	rv := c.resources()
+	node := rv.buildNode(c.serviceName)
+	if withMeta, ok := node.(interface{ GetMetadata() *types.Struct }); ok {
+		withMeta.GetMetadata().Fields[endpointRequired] = &types.Value{
+			Kind: &types.Value_BoolValue{BoolValue: c.enableCDS},
+		}
 	}
-	return edsReq
+	return t.request(rv, rv.edsType, []string{c.serviceName}, node)
 }
 
 func (c *client) makeADSCall() {
-	c.cli = xdsdiscoverypb.NewAggregatedDiscoveryServiceClient(c.cc)
 	retryCount := 0
 	var doRetry bool
 
@@ -179,8 +202,8 @@ func (c *client) makeADSCall() {
 			retryCount++
 		}
 
-		firstRespReceived := c.adsCallAttempt()
-		if firstRespReceived {
+		firstRespReceived, healthyFor := c.adsCallAttempt()
+		if firstRespReceived && healthyFor >= c.minConnectTimeout {
 			retryCount = 0
 			doRetry = false
 		} else {
@@ -190,74 +213,219 @@ func (c *client) makeADSCall() {
 	}
 }
 
-func (c *client) adsCallAttempt() (firstRespReceived bool) {
-	firstRespReceived = false
+// adsSender serializes DiscoveryRequests onto st.SendRequest: responses are
+// processed synchronously in adsCallAttempt's loop, but ACK/NACK requests
+// are triggered from there too, so without this goroutine two call sites
+// could race to call st.SendRequest concurrently.
+func adsSender(ctx context.Context, st Stream, reqs <-chan proto.Message) {
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return
+			}
+			if err := st.SendRequest(req); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendReq enqueues req for adsSender without blocking forever: adsSender
+// can exit via ctx.Done() (e.g. the client is closing) while reqs is full,
+// in which case nothing ever drains the channel again and an unconditional
+// send would hang adsCallAttempt's caller permanently. It reports whether
+// req was actually enqueued; false means the stream is done and the
+// caller should return.
+func sendReq(ctx context.Context, reqs chan<- proto.Message, req proto.Message) bool {
+	select {
+	case reqs <- req:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// adsCallAttempt makes one ADS streaming attempt. healthyFor reports how
+// long the stream stayed up and kept receiving responses before it broke
+// (zero if no response was ever received), which makeADSCall compares
+// against c.minConnectTimeout to decide whether to reset its retry count.
+func (c *client) adsCallAttempt() (firstRespReceived bool, healthyFor time.Duration) {
+	rv := c.resources()
 	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
-	st, err := c.cli.StreamAggregatedResources(ctx, grpc.WaitForReady(true))
+	st, err := c.transport.NewStream(ctx, rv.adsMethod)
 	if err != nil {
 		grpclog.Infof("xds: failed to initial ADS streaming RPC due to %v", err)
-		return
+		return false, 0
+	}
+	defer st.Close()
+
+	var firstRespTime time.Time
+	defer func() {
+		if firstRespReceived {
+			healthyFor = time.Since(firstRespTime)
+		}
+	}()
+
+	reqs := make(chan proto.Message, 1)
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		// A failed send ends adsSender; cancel so sendReq stops waiting
+		// on reqs and the stream's RecvResponse returns.
+		defer cancel()
+		adsSender(ctx, st, reqs)
+	}()
+	defer func() {
+		// Cancel first so adsSender is unblocked if it's parked in
+		// st.SendRequest; otherwise closing reqs wouldn't wake it and
+		// <-sendDone could wait on a cancellation that only happens
+		// after this deferred func returns (defers run in LIFO order,
+		// so the top-level defer cancel() would fire too late).
+		cancel()
+		close(reqs)
+		<-sendDone
+	}()
+
+	tracker := c.ackTracker
+	if c.newLDS != nil {
+		if !sendReq(ctx, reqs, c.newLDSRequest(tracker)) {
+			return
+		}
 	}
 	if c.enableCDS {
-		if err := st.Send(c.newCDSRequest()); err != nil {
-			// current stream is broken, start a new one.
+		if !sendReq(ctx, reqs, c.newCDSRequest(tracker)) {
 			return
 		}
 	}
-	if err := st.Send(c.newEDSRequest()); err != nil {
-		// current stream is broken, start a new one.
+	if !sendReq(ctx, reqs, c.newEDSRequest(tracker)) {
 		return
 	}
 	expectCDS := c.enableCDS
 	for {
-		resp, err := st.Recv()
-		if err != nil {
+		resp := rv.newResponse()
+		if err := st.RecvResponse(resp); err != nil {
 			// current stream is broken, start a new one.
 			return
 		}
-		firstRespReceived = true
-		resources := resp.GetResources()
+		if !firstRespReceived {
+			firstRespReceived = true
+			firstRespTime = time.Now()
+		}
+		typeURL, resources, versionInfo, nonce := rv.parseResponse(resp)
 		if len(resources) < 1 {
 			grpclog.Warning("xds: ADS response contains 0 resource info.")
 			// start a new call as server misbehaves by sending a ADS response with 0 resource info.
 			return
 		}
-		if resp.GetTypeUrl() == cdsType && !c.enableCDS {
+		if typeURL == rv.cdsType && !c.enableCDS {
 			grpclog.Warning("xds: received CDS response in custom plugin mode.")
 			// start a new call as we receive CDS response when in EDS-only mode.
 			return
 		}
 		var adsResp types.DynamicAny
 		if err := types.UnmarshalAny(&resources[0], &adsResp); err != nil {
-			grpclog.Warningf("xds: failed to unmarshal resources due to %v.", err)
-			return
+			grpclog.Warningf("xds: failed to unmarshal resources due to %v, NACKing", err)
+			if !sendReq(ctx, reqs, tracker.nack(rv, typeURL, nonce, &rpcstatus.Status{
+				Code:    int32(codes.Internal),
+				Message: err.Error(),
+			})) {
+				return
+			}
+			continue
 		}
-		switch adsResp.Message.(type) {
-		case *xdspb.Cluster:
+		switch typeURL {
+		case rv.cdsType:
 			expectCDS = false
-		case *xdspb.ClusterLoadAssignment:
+		case rv.edsType:
 			if expectCDS {
 				grpclog.Warningf("xds: expecting CDS response, got EDS response instead.")
 				return
 			}
 		}
-		if err := c.newADS(c.ctx, adsResp.Message); err != nil {
-			grpclog.Warningf("xds: processing new ADS message failed due to %v.", err)
+		if err := c.dispatch(typeURL, adsResp.Message); err != nil {
+			grpclog.Warningf("xds: processing new ADS message failed due to %v, NACKing", err)
+			if !sendReq(ctx, reqs, tracker.nack(rv, typeURL, nonce, &rpcstatus.Status{
+				Code:    int32(codes.Internal),
+				Message: err.Error(),
+			})) {
+				return
+			}
+			continue
+		}
+		if !sendReq(ctx, reqs, tracker.ack(rv, typeURL, versionInfo, nonce)) {
 			return
 		}
+		switch typeURL {
+		case rv.ldsType:
+			// Follow the Listener to its RouteConfiguration, so an
+			// xdsResolver watching newLDS/newRDS sees both halves of a
+			// consistent Listener/Route pair.
+			if name := routeConfigName(adsResp.Message); name != "" {
+				if !sendReq(ctx, reqs, c.newRDSRequest(tracker, name)) {
+					return
+				}
+			}
+		case rv.rdsType:
+			// Narrow the wildcard CDS subscription to the cluster the
+			// matched VirtualHost actually routes to.
+			// In EDS-only mode there is no CDS subscription to narrow.
+			if cluster := clusterForService(adsResp.Message, c.serviceName); c.enableCDS && cluster != "" {
+				if !sendReq(ctx, reqs, c.newCDSRequestForCluster(tracker, cluster)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatch delivers resp, already unwrapped from the DiscoveryResponse's
+// Any, to the callback registered for typeURL. It is a no-op if the
+// embedder left that resource's callback nil.
+func (c *client) dispatch(typeURL string, resp proto.Message) error {
+	rv := c.resources()
+	var cb func(ctx context.Context, resp proto.Message) error
+	switch typeURL {
+	case rv.ldsType:
+		cb = c.newLDS
+	case rv.rdsType:
+		cb = c.newRDS
+	case rv.cdsType:
+		cb = c.newCDS
+	case rv.edsType:
+		cb = c.newEDS
+	}
+	if cb == nil {
+		return nil
 	}
+	return cb(c.ctx, resp)
 }
-func newXDSClient(balancerName string, serviceName string, enableCDS bool, opts balancer.BuildOptions, newADS func(context.Context, proto.Message) error, loseContact func(ctx context.Context), exitCleanup func()) *client {
+
+func newXDSClient(balancerName string, serviceName string, enableCDS bool, transportVersion TransportVersion, opts balancer.BuildOptions, transportBuilder TransportBuilder, lrsStore *Store, connectParams *ConnectParams, newLDS, newRDS, newCDS, newEDS func(context.Context, proto.Message) error, loseContact func(ctx context.Context), exitCleanup func()) *client {
+	cp := DefaultConnectParams
+	if connectParams != nil {
+		cp = *connectParams
+	}
 	c := &client{
-		balancerName: balancerName,
-		serviceName:  serviceName,
-		enableCDS:    enableCDS,
-		opts:         opts,
-		newADS:       newADS,
-		loseContact:  loseContact,
-		cleanup:      exitCleanup,
-		backoff:      defaultBackoffConfig,
+		balancerName:      balancerName,
+		serviceName:       serviceName,
+		enableCDS:         enableCDS,
+		transportVersion:  transportVersion,
+		opts:              opts,
+		transportBuilder:  transportBuilder,
+		lrsStore:          lrsStore,
+		newLDS:            newLDS,
+		newRDS:            newRDS,
+		newCDS:            newCDS,
+		newEDS:            newEDS,
+		loseContact:       loseContact,
+		cleanup:           exitCleanup,
+		backoff:           connectParamsBackoff{ConnectParams: cp},
+		minConnectTimeout: cp.MinConnectTimeout,
+		ackTracker:        newAckTracker(),
 	}
 
 	c.ctx, c.cancel = context.WithCancel(context.Background())
@@ -0,0 +1,110 @@
+// +build go1.12
+
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xds
+
+import (
+	xdspb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	v3listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	v3routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v3hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+)
+
+// As in xds_version.go, the v3 listener/route/HCM types below must come
+// from a gogo/protobuf-generated go-control-plane build so that they
+// satisfy gogo's proto.Message and types.UnmarshalAny; see the assertions
+// there for the matching requirement on the v3 discovery types.
+var (
+	_ proto.Message = (*v3listenerpb.Listener)(nil)
+	_ proto.Message = (*v3routepb.RouteConfiguration)(nil)
+	_ proto.Message = (*v3hcmpb.HttpConnectionManager)(nil)
+)
+
+// routeConfigName extracts the RDS resource name a Listener defers its
+// routing configuration to, i.e. api_listener -> HttpConnectionManager ->
+// rds.route_config_name. It returns "" if the listener could not be parsed
+// or embeds a RouteConfiguration directly instead of deferring to RDS, in
+// which case there is nothing for the client to additionally subscribe to.
+func routeConfigName(listener proto.Message) string {
+	switch l := listener.(type) {
+	case *xdspb.Listener:
+		hcm := new(hcmpb.HttpConnectionManager)
+		if err := types.UnmarshalAny(l.GetApiListener().GetApiListener(), hcm); err != nil {
+			return ""
+		}
+		return hcm.GetRds().GetRouteConfigName()
+	case *v3listenerpb.Listener:
+		hcm := new(v3hcmpb.HttpConnectionManager)
+		if err := types.UnmarshalAny(l.GetApiListener().GetApiListener(), hcm); err != nil {
+			return ""
+		}
+		return hcm.GetRds().GetRouteConfigName()
+	default:
+		return ""
+	}
+}
+
+// clusterForService walks a RouteConfiguration's VirtualHosts, in order,
+// whose domains match serviceName and returns the first route action that
+// names a single cluster, i.e. the CDS resource name the client should
+// resolve the service to next. Routes without a single cluster (e.g.
+// weighted clusters) are skipped. It returns "" if no matching route
+// could be found.
+func clusterForService(routeConfig proto.Message, serviceName string) string {
+	switch rc := routeConfig.(type) {
+	case *xdspb.RouteConfiguration:
+		for _, vh := range rc.GetVirtualHosts() {
+			if !domainsMatch(vh.GetDomains(), serviceName) {
+				continue
+			}
+			for _, route := range vh.GetRoutes() {
+				if c := route.GetRoute().GetCluster(); c != "" {
+					return c
+				}
+			}
+		}
+	case *v3routepb.RouteConfiguration:
+		for _, vh := range rc.GetVirtualHosts() {
+			if !domainsMatch(vh.GetDomains(), serviceName) {
+				continue
+			}
+			for _, route := range vh.GetRoutes() {
+				if c := route.GetRoute().GetCluster(); c != "" {
+					return c
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// domainsMatch reports whether serviceName is one of a VirtualHost's
+// domains, honoring the "*" catch-all domain.
+func domainsMatch(domains []string, serviceName string) bool {
+	for _, d := range domains {
+		if d == "*" || d == serviceName {
+			return true
+		}
+	}
+	return false
+}
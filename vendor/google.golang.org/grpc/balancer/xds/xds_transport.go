@@ -0,0 +1,134 @@
+// +build go1.12
+
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xds
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/internal/channelz"
+)
+
+// Stream is the bidirectional message exchange a Transport hands back for a
+// single long-lived xDS or LRS RPC. It is deliberately proto.Message-typed
+// rather than tied to any one DiscoveryRequest/Response pair, so the same
+// interface serves ADS (version-specific wire types, see xds_version.go)
+// and LRS.
+type Stream interface {
+	// SendRequest marshals and sends req on the stream.
+	SendRequest(req proto.Message) error
+	// RecvResponse blocks for the next message and unmarshals it into
+	// resp, which must be a pointer to the response's concrete type.
+	RecvResponse(resp proto.Message) error
+	// Close tears down the stream. Safe to call more than once.
+	Close()
+}
+
+// Transport abstracts how the client talks to its control plane, so
+// adsCallAttempt and lrsCallAttempt can be driven deterministically in
+// tests with a fake Transport, and so embedders can plug in a transport
+// other than gRPC (e.g. file-backed or in-process) for a non-networked
+// control plane.
+type Transport interface {
+	// NewStream opens a new stream to the given RPC method, e.g. the
+	// version-specific ADS method from resourceVersion.adsMethod or
+	// lrsMethod.
+	NewStream(ctx context.Context, method string) (Stream, error)
+	// Close releases any resources (e.g. the underlying ClientConn) held
+	// by the transport.
+	Close() error
+}
+
+// TransportBuilder constructs a Transport for balancerName. opts carries
+// the dial credentials/dialer/channelz parent that the default gRPC
+// transport needs; other Transport implementations may ignore it.
+type TransportBuilder func(ctx context.Context, balancerName string, opts balancer.BuildOptions) (Transport, error)
+
+// newTransportBuilder is the TransportBuilder used whenever newXDSClient is
+// not given one explicitly. Tests can swap it for a builder that returns a
+// fake Transport without dialing anything; production callers should leave
+// it alone and get grpcTransport.
+var newTransportBuilder TransportBuilder = newGRPCTransport
+
+// grpcTransport is the default Transport, backed by a grpc.ClientConn to
+// the traffic director, matching the client's dialing behavior prior to
+// the introduction of the Transport interface.
+type grpcTransport struct {
+	cc *grpc.ClientConn
+}
+
+func newGRPCTransport(ctx context.Context, balancerName string, opts balancer.BuildOptions) (Transport, error) {
+	var dopts []grpc.DialOption
+	if creds := opts.DialCreds; creds != nil {
+		if err := creds.OverrideServerName(balancerName); err == nil {
+			dopts = append(dopts, grpc.WithTransportCredentials(creds))
+		} else {
+			grpclog.Warningf("xds: failed to override the server name in the credentials: %v, using Insecure", err)
+			dopts = append(dopts, grpc.WithInsecure())
+		}
+	} else {
+		dopts = append(dopts, grpc.WithInsecure())
+	}
+	if opts.Dialer != nil {
+		dopts = append(dopts, grpc.WithContextDialer(opts.Dialer))
+	}
+	// Explicitly set pickfirst as the balancer.
+	dopts = append(dopts, grpc.WithBalancerName(grpc.PickFirstBalancerName))
+	if channelz.IsOn() {
+		dopts = append(dopts, grpc.WithChannelzParentID(opts.ChannelzParentID))
+	}
+
+	cc, err := grpc.DialContext(ctx, balancerName, dopts...)
+	// Since this is a non-blocking dial, if it fails it's due to some
+	// serious (not network related) error.
+	if err != nil {
+		grpclog.Fatalf("xds: failed to dial: %v", err)
+	}
+	return &grpcTransport{cc: cc}, nil
+}
+
+func (t *grpcTransport) NewStream(ctx context.Context, method string) (Stream, error) {
+	desc := adsStreamDesc
+	if method == lrsMethod {
+		desc = lrsStreamDesc
+	}
+	st, err := t.cc.NewStream(ctx, desc, method, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcStream{st: st}, nil
+}
+
+func (t *grpcTransport) Close() error {
+	return t.cc.Close()
+}
+
+// grpcStream adapts a grpc.ClientStream to the Stream interface.
+type grpcStream struct {
+	st grpc.ClientStream
+}
+
+func (s *grpcStream) SendRequest(req proto.Message) error   { return s.st.SendMsg(req) }
+func (s *grpcStream) RecvResponse(resp proto.Message) error { return s.st.RecvMsg(resp) }
+func (s *grpcStream) Close()                                {}
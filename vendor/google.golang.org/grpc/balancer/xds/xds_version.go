@@ -0,0 +1,195 @@
+// +build go1.12
+
+/*
+ *
+ * Copyright 2019 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xds
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+
+	xdspb "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	xdscorepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	v3corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	rpcstatus "github.com/gogo/googleapis/google/rpc"
+	"google.golang.org/grpc"
+)
+
+// TransportVersion identifies the xDS transport protocol version that a
+// client negotiates with its control plane. Resource type URLs, the
+// DiscoveryRequest/DiscoveryResponse wire types, and the ADS method name
+// all vary by version, so every version-specific detail is routed through
+// the resourceVersion looked up for the chosen value.
+type TransportVersion int
+
+const (
+	// TransportV2 speaks the v2 xDS transport protocol (envoy.api.v2.*).
+	// This is the default, for backward compatibility with existing
+	// deployments.
+	TransportV2 TransportVersion = iota
+	// TransportV3 speaks the v3 xDS transport protocol
+	// (envoy.config.*.v3.*), including the renamed ADS service.
+	TransportV3
+)
+
+const (
+	userAgentName = "gRPC Go"
+
+	ldsTypeV2 = "type.googleapis.com/envoy.api.v2.Listener"
+	rdsTypeV2 = "type.googleapis.com/envoy.api.v2.RouteConfiguration"
+	cdsTypeV2 = "type.googleapis.com/envoy.api.v2.Cluster"
+	edsTypeV2 = "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment"
+
+	ldsTypeV3 = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	rdsTypeV3 = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+	cdsTypeV3 = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	edsTypeV3 = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	adsMethodV2 = "/envoy.service.discovery.v2.AggregatedDiscoveryService/StreamAggregatedResources"
+	adsMethodV3 = "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"
+)
+
+// resourceVersion bundles everything that is specific to an xDS transport
+// version: the LDS/RDS/CDS/EDS resource type URLs, the ADS stream method,
+// how to build the Node identification proto, and how to construct/parse
+// the version's concrete DiscoveryRequest/DiscoveryResponse wire types.
+// adsCallAttempt only ever interacts with these through the interface
+// below, so it never needs to know which concrete version it's talking to.
+type resourceVersion struct {
+	ldsType   string
+	rdsType   string
+	cdsType   string
+	edsType   string
+	adsMethod string
+
+	buildNode func(serviceName string) proto.Message
+	// newRequest builds a DiscoveryRequest of the right concrete wire type.
+	// versionInfo/nonce are empty on the very first request for a type
+	// URL; subsequent calls echo the version_info/response_nonce being
+	// ACKed or NACKed, with errDetail set only on a NACK.
+	newRequest func(typeURL string, resourceNames []string, node proto.Message, versionInfo, nonce string, errDetail *rpcstatus.Status) proto.Message
+	// newResponse returns a pointer to a zero-value DiscoveryResponse of
+	// the right concrete wire type, suitable for use with RecvMsg.
+	newResponse func() proto.Message
+	// parseResponse extracts the fields adsCallAttempt and the ACK/NACK
+	// state machine care about from a DiscoveryResponse built by
+	// newResponse.
+	parseResponse func(resp proto.Message) (typeURL string, resources []types.Any, versionInfo, nonce string)
+}
+
+var resourceVersions = map[TransportVersion]resourceVersion{
+	TransportV2: {
+		ldsType:   ldsTypeV2,
+		rdsType:   rdsTypeV2,
+		cdsType:   cdsTypeV2,
+		edsType:   edsTypeV2,
+		adsMethod: adsMethodV2,
+		buildNode: func(serviceName string) proto.Message {
+			return &xdscorepb.Node{
+				Metadata: &types.Struct{
+					Fields: map[string]*types.Value{
+						grpcHostname: {Kind: &types.Value_StringValue{StringValue: serviceName}},
+					},
+				},
+				UserAgentName:        userAgentName,
+				UserAgentVersionType: &xdscorepb.Node_UserAgentVersion{UserAgentVersion: grpc.Version},
+			}
+		},
+		newRequest: func(typeURL string, resourceNames []string, node proto.Message, versionInfo, nonce string, errDetail *rpcstatus.Status) proto.Message {
+			req := &xdspb.DiscoveryRequest{
+				ResourceNames: resourceNames,
+				TypeUrl:       typeURL,
+				VersionInfo:   versionInfo,
+				ResponseNonce: nonce,
+				ErrorDetail:   errDetail,
+			}
+			if node != nil {
+				req.Node, _ = node.(*xdscorepb.Node)
+			}
+			return req
+		},
+		newResponse: func() proto.Message { return new(xdspb.DiscoveryResponse) },
+		parseResponse: func(resp proto.Message) (string, []types.Any, string, string) {
+			r := resp.(*xdspb.DiscoveryResponse)
+			return r.GetTypeUrl(), r.GetResources(), r.GetVersionInfo(), r.GetNonce()
+		},
+	},
+	TransportV3: {
+		ldsType:   ldsTypeV3,
+		rdsType:   rdsTypeV3,
+		cdsType:   cdsTypeV3,
+		edsType:   edsTypeV3,
+		adsMethod: adsMethodV3,
+		buildNode: func(serviceName string) proto.Message {
+			return &v3corepb.Node{
+				Metadata: &types.Struct{
+					Fields: map[string]*types.Value{
+						grpcHostname: {Kind: &types.Value_StringValue{StringValue: serviceName}},
+					},
+				},
+				UserAgentName:        userAgentName,
+				UserAgentVersionType: &v3corepb.Node_UserAgentVersion{UserAgentVersion: grpc.Version},
+			}
+		},
+		newRequest: func(typeURL string, resourceNames []string, node proto.Message, versionInfo, nonce string, errDetail *rpcstatus.Status) proto.Message {
+			req := &v3discoverypb.DiscoveryRequest{
+				ResourceNames: resourceNames,
+				TypeUrl:       typeURL,
+				VersionInfo:   versionInfo,
+				ResponseNonce: nonce,
+				ErrorDetail:   errDetail,
+			}
+			if node != nil {
+				req.Node, _ = node.(*v3corepb.Node)
+			}
+			return req
+		},
+		newResponse: func() proto.Message { return new(v3discoverypb.DiscoveryResponse) },
+		parseResponse: func(resp proto.Message) (string, []types.Any, string, string) {
+			r := resp.(*v3discoverypb.DiscoveryResponse)
+			return r.GetTypeUrl(), r.GetResources(), r.GetVersionInfo(), r.GetNonce()
+		},
+	},
+}
+
+// The v3 resourceVersion above is only valid if envoy/config/core/v3 and
+// envoy/service/discovery/v3 were generated with gogo/protobuf, matching
+// the v2 packages: Stream.SendRequest/RecvResponse, types.UnmarshalAny,
+// and parseResponse's []types.Any all assume the gogo proto.Message and
+// gogo-flavored Any. A vendored go-control-plane built against
+// google.golang.org/protobuf instead (golang-proto Any, []*anypb.Any
+// Resources) does not satisfy these and must not be substituted here; use
+// a gogo-generated build of the v3 packages.
+var (
+	_ proto.Message = (*v3corepb.Node)(nil)
+	_ proto.Message = (*v3discoverypb.DiscoveryRequest)(nil)
+	_ proto.Message = (*v3discoverypb.DiscoveryResponse)(nil)
+)
+
+// resources returns the resourceVersion for c's TransportVersion, falling
+// back to v2 for any value not in resourceVersions. The zero value is
+// TransportV2, so existing callers of newXDSClient that never set a
+// version keep behaving exactly as before.
+func (c *client) resources() resourceVersion {
+	if rv, ok := resourceVersions[c.transportVersion]; ok {
+		return rv
+	}
+	return resourceVersions[TransportV2]
+}